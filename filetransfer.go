@@ -0,0 +1,389 @@
+// Copyright (C) 2014 Andrew Clausen
+// This program may be distributed under the BSD-style licence that Go is
+// released under; see https://golang.org/LICENSE.
+//
+// This file implements the sendfile/recvfile subcommands, which stream a
+// file through the authenticated OTR conversation instead of interactive
+// text.  Because OTR only carries UTF-8 text (see the NUL-byte check in
+// mainLoop), each chunk is base64-encoded and wrapped in a small JSON
+// envelope describing the file and the chunk's position within it.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/otr"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileChunkSize is the amount of raw file data carried per chunk.  It's kept
+// well under readLoop's 4096-byte buffer once base64-encoded and wrapped in
+// its JSON envelope.
+const fileChunkSize = 2048
+
+// fileChunk is the JSON envelope a chunk of the file is wrapped in before
+// being sent as a single OTR message.
+type fileChunk struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"` // of the whole file, hex-encoded
+	Index       int    `json:"index"`  // zero-based
+	TotalChunks int    `json:"total_chunks"`
+	Data        string `json:"data"`         // base64-encoded chunk contents
+	ChunkSHA256 string `json:"chunk_sha256"` // of this chunk's raw data, hex-encoded
+}
+
+var resume bool
+
+// resumeWaitTimeout bounds how long a resuming sendfile waits for the
+// receiver's resumeNotice before giving up and sending the whole file; a
+// peer without -resume never sends one.
+const resumeWaitTimeout = 2 * time.Second
+
+func fileFlag(f *flag.FlagSet) {
+	f.StringVar(&filePath, "file", "", "path of the file to send or receive")
+}
+
+func resumeFlag(f *flag.FlagSet) {
+	f.BoolVar(&resume, "resume", false,
+		"resume an interrupted transfer: on recvfile, skip re-writing chunks "+
+			"the destination file already has; on sendfile, skip re-sending "+
+			"the chunks the receiver reports it already has (only if it was "+
+			"also given -resume)")
+}
+
+// resumeNotice is sent once by a resuming recvfile, before any chunk data,
+// telling the sender how many leading chunks the destination file already
+// holds correctly, so the sender can skip re-sending them.
+type resumeNotice struct {
+	ResumeFrom int `json:"resume_from"`
+}
+
+var filePath string
+
+// payloadIO, if set, overrides mainLoop's choice of what to hook up to the
+// conversation once it's authorised (normally stdin/stdout, or -exec).
+// sendfile/recvfile use it to stream a file instead of interactive text.
+var payloadIO func(fingerprint string) (io.Reader, io.Writer)
+
+func sendfile() {
+	var conv otr.Conversation
+	useKey(&conv, contacts, contactsReverse, loadKey(privateKeyPath))
+	loadContacts(contactsPath, contacts, contactsReverse)
+	parseConversationFlags()
+	if filePath == "" {
+		exitPrintf("sendfile needs -file to know what to send.\n")
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		exitError(err)
+	}
+	name := filepath.Base(filePath)
+
+	// If we're resuming, the peer may tell us (via a resumeNotice) how many
+	// leading chunks it already has, so we can skip re-sending them.  Without
+	// -resume, sendWriter stays a plain discard and nothing waits for it.
+	var sendWriter io.Writer = ioutil.Discard
+	var resumeCh chan int
+	if resume {
+		resumeCh = make(chan int, 1)
+		sendWriter = resumeNoticeWriter{resumeCh}
+	}
+	sender := newFileSender(name, data, resumeCh)
+	payloadIO = func(fingerprint string) (io.Reader, io.Writer) {
+		return sender, sendWriter
+	}
+
+	conn, err := transport().Dial(address)
+	if err != nil {
+		exitError(err)
+	}
+	if err := mainLoop(conn, &conv, contacts, contactsReverse, nil); err != nil {
+		exitError(err)
+	}
+	conn.Close()
+}
+
+func recvfile() {
+	var conv otr.Conversation
+	useKey(&conv, contacts, contactsReverse, loadKey(privateKeyPath))
+	loadContacts(contactsPath, contacts, contactsReverse)
+	parseConversationFlags()
+	if filePath == "" {
+		exitPrintf("recvfile needs -file to know where to save the file.\n")
+	}
+
+	receiver := newFileReceiver(filePath)
+	payloadIO = func(fingerprint string) (io.Reader, io.Writer) {
+		var r io.Reader = blockingReader{}
+		if resume {
+			if resumeFrom := receiver.resumeFrom(); resumeFrom > 0 {
+				fmt.Fprintf(os.Stderr,
+					"Telling the sender we already have %d chunk(s).\n", resumeFrom)
+				r = newResumeReader(resumeFrom)
+			}
+		}
+		return r, receiver
+	}
+
+	conn, err := transport().Listen(address)
+	if err != nil {
+		exitError(err)
+	}
+	if err := mainLoop(conn, &conv, contacts, contactsReverse, nil); err != nil {
+		exitError(err)
+	}
+	conn.Close()
+}
+
+// blockingReader never produces data.  recvfile uses it because it never
+// sends anything back across the conversation, and readLoop closing its
+// input channel early would tear the conversation down before the transfer
+// finishes.
+type blockingReader struct{}
+
+func (blockingReader) Read(p []byte) (int, error) {
+	select {}
+}
+
+// resumeReader sends a single resumeNotice, then blocks forever like
+// blockingReader.  A resuming recvfile uses it in place of blockingReader
+// when the destination file already has some complete leading chunks.
+type resumeReader struct {
+	notice []byte
+}
+
+func newResumeReader(resumeFrom int) *resumeReader {
+	encoded, err := json.Marshal(resumeNotice{ResumeFrom: resumeFrom})
+	if err != nil {
+		exitError(err)
+	}
+	return &resumeReader{encoded}
+}
+
+func (r *resumeReader) Read(buf []byte) (int, error) {
+	if r.notice != nil {
+		n := copy(buf, r.notice)
+		r.notice = nil
+		return n, nil
+	}
+	select {}
+}
+
+// resumeNoticeWriter watches sendfile's incoming messages for a
+// resumeNotice and forwards its ResumeFrom value to resumeCh.  A resuming
+// sendfile uses it in place of ioutil.Discard, so it can learn how many
+// leading chunks to skip re-sending.  Anything that isn't a resumeNotice
+// (i.e. the peer isn't resuming) is silently discarded, same as before.
+type resumeNoticeWriter struct {
+	resumeCh chan int
+}
+
+func (w resumeNoticeWriter) Write(buf []byte) (int, error) {
+	var notice resumeNotice
+	if err := json.Unmarshal(buf, &notice); err == nil && notice.ResumeFrom > 0 {
+		select {
+		case w.resumeCh <- notice.ResumeFrom:
+		default:
+		}
+	}
+	return len(buf), nil
+}
+
+// fileSender is an io.Reader that yields the file, one JSON-wrapped,
+// base64-encoded chunk per Read call, for mainLoop's readLoop to pass to
+// conv.Send() a chunk at a time.  If resumeCh is non-nil, the first Read
+// waits briefly for the receiver's resumeNotice and skips ahead to the
+// index it reports, but always sends the last chunk, so the receiver still
+// runs its whole-file checksum check.
+type fileSender struct {
+	name       string
+	data       []byte
+	sum        string
+	index      int
+	resumeCh   chan int
+	waitedOnce bool
+}
+
+func newFileSender(name string, data []byte, resumeCh chan int) *fileSender {
+	return &fileSender{name: name, data: data, sum: hexSHA256(data), resumeCh: resumeCh}
+}
+
+func (s *fileSender) totalChunks() int {
+	if len(s.data) == 0 {
+		return 1
+	}
+	return (len(s.data) + fileChunkSize - 1) / fileChunkSize
+}
+
+func (s *fileSender) Read(buf []byte) (int, error) {
+	if s.resumeCh != nil && !s.waitedOnce {
+		s.waitedOnce = true
+		select {
+		case resumeFrom := <-s.resumeCh:
+			if resumeFrom == s.totalChunks() {
+				resumeFrom--
+			}
+			if resumeFrom > s.index && resumeFrom < s.totalChunks() {
+				fmt.Fprintf(os.Stderr,
+					"Resuming: skipping %d chunk(s) the receiver already has.\n", resumeFrom)
+				s.index = resumeFrom
+			}
+		case <-time.After(resumeWaitTimeout):
+		}
+	}
+
+	total := s.totalChunks()
+	if s.index >= total {
+		return 0, io.EOF
+	}
+
+	start := s.index * fileChunkSize
+	end := start + fileChunkSize
+	if end > len(s.data) {
+		end = len(s.data)
+	}
+	raw := s.data[start:end]
+
+	encoded, err := json.Marshal(fileChunk{
+		Name:        s.name,
+		Size:        int64(len(s.data)),
+		SHA256:      s.sum,
+		Index:       s.index,
+		TotalChunks: total,
+		Data:        base64.StdEncoding.EncodeToString(raw),
+		ChunkSHA256: hexSHA256(raw),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(encoded) > len(buf) {
+		return 0, fmt.Errorf("file chunk too large to send (%d > %d bytes)",
+			len(encoded), len(buf))
+	}
+
+	s.index++
+	fmt.Fprintf(os.Stderr, "\rSending %s: chunk %d/%d (%d%%)",
+		s.name, s.index, total, 100*s.index/total)
+	if s.index == total {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+
+	return copy(buf, encoded), nil
+}
+
+// fileReceiver is an io.Writer that reassembles the chunks written to it
+// (each Write call is exactly one OTR message, and so exactly one chunk)
+// into the destination file, verifying hashes as it goes.
+type fileReceiver struct {
+	file *os.File
+}
+
+func newFileReceiver(path string) *fileReceiver {
+	// O_RDWR (not O_WRONLY): haveChunk and resumeFrom both need to read back
+	// what's already on disk, to dedupe or skip-ahead on -resume.
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		exitError(err)
+	}
+	return &fileReceiver{file}
+}
+
+// Write returns a real error (rather than exiting the process) for every
+// failure, and errPayloadDone once the last chunk has arrived and passed
+// its whole-file checksum, so mainLoop's writeLoop reports both through
+// errChan and mainLoop can run its own shutdown (sending the OTR
+// termination messages) instead of the transfer hard-exiting underneath it.
+func (r *fileReceiver) Write(buf []byte) (int, error) {
+	var chunk fileChunk
+	if err := json.Unmarshal(buf, &chunk); err != nil {
+		return 0, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		return 0, err
+	}
+	if hexSHA256(raw) != chunk.ChunkSHA256 {
+		return 0, fmt.Errorf("chunk %d/%d of %s failed its checksum; aborting",
+			chunk.Index+1, chunk.TotalChunks, chunk.Name)
+	}
+
+	if !resume || !r.haveChunk(chunk.Index, raw) {
+		if _, err := r.file.WriteAt(raw, int64(chunk.Index)*fileChunkSize); err != nil {
+			return 0, err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "\rReceiving %s: chunk %d/%d (%d%%)",
+		chunk.Name, chunk.Index+1, chunk.TotalChunks,
+		100*(chunk.Index+1)/chunk.TotalChunks)
+
+	if chunk.Index+1 == chunk.TotalChunks {
+		fmt.Fprintf(os.Stderr, "\n")
+		if err := r.finish(chunk); err != nil {
+			return 0, err
+		}
+		return len(buf), errPayloadDone
+	}
+	return len(buf), nil
+}
+
+// haveChunk reports whether the destination file already holds this chunk's
+// data at the right offset, for -resume.
+func (r *fileReceiver) haveChunk(index int, raw []byte) bool {
+	existing := make([]byte, len(raw))
+	n, err := r.file.ReadAt(existing, int64(index)*fileChunkSize)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return n == len(raw) && bytes.Equal(existing, raw)
+}
+
+// resumeFrom returns how many leading chunks the destination file already
+// holds, based on its current size, for -resume to report to the sender.
+// A short or corrupt prefix is still caught by the whole-file checksum
+// check in finish once the (possibly truncated) transfer completes.
+func (r *fileReceiver) resumeFrom() int {
+	info, err := r.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return int(info.Size() / fileChunkSize)
+}
+
+// finish closes the destination file and verifies its whole-file checksum
+// once the last chunk has arrived.  It returns an error rather than exiting,
+// so Write can report it through errChan and let mainLoop decide how to shut
+// down.
+func (r *fileReceiver) finish(chunk fileChunk) error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(r.file.Name())
+	if err != nil {
+		return err
+	}
+	if hexSHA256(data) != chunk.SHA256 {
+		return fmt.Errorf("whole-file checksum mismatch for %s; the transfer is corrupt",
+			chunk.Name)
+	}
+	fmt.Fprintf(os.Stderr, "Received %s (%d bytes); checksum verified.\n",
+		chunk.Name, chunk.Size)
+	return nil
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%x", sum)
+}
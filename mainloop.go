@@ -10,6 +10,7 @@ package main
 import (
 	"bytes"
 	"code.google.com/p/go.crypto/otr"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,29 +18,39 @@ import (
 	"os/signal"
 )
 
+// errPayloadDone is reported on errChan by a payload writer (e.g.
+// fileReceiver.Write) to mean the payload finished successfully and the
+// conversation should now wind down gracefully, rather than that something
+// went wrong.  mainLoop treats it like reaching the end of stdin: it sends
+// the OTR termination messages and waits for the peer to close the
+// connection, instead of returning an error.
+var errPayloadDone = errors.New("payload finished")
+
 // Checks if the contact is authorised, and remembers the contact if
 // appropriate.  This is the only place these tasks are done, with the
 // following exceptions:
 // * "me" is included in the contact list
 // * the main loop checks if the contact changed mid-conversation (which we
 // forbid)
-func authoriseRemember(fingerprint string) {
+// Returns an error instead of exiting, so mainLoop can report a failed
+// authorisation back to its caller rather than killing the process.
+func authoriseRemember(fingerprint string, contacts, contactsReverse map[string]string) error {
 	name, known := contactsReverse[fingerprint]
 	if expect != "" {
 		if !known {
-			exitPrintf("Expected contact '%s', but the contact is unknown.\n",
+			return fmt.Errorf("Expected contact '%s', but the contact is unknown.",
 				expect)
 		}
 		if name != expect {
-			exitPrintf("Expected contact '%s', but the contact is '%s'.\n",
+			return fmt.Errorf("Expected contact '%s', but the contact is '%s'.",
 				expect, name)
 		}
-		return // authorised
+		return nil // authorised
 	}
 
 	if !anyone && !known {
-		exitPrintf("The contact is unknown.  " +
-			"Use -anyone or -remember to talk to unknown contacts.\n")
+		return fmt.Errorf("The contact is unknown.  " +
+			"Use -anyone or -remember to talk to unknown contacts.")
 	}
 
 	if remember != "" && known {
@@ -53,17 +64,18 @@ func authoriseRemember(fingerprint string) {
 		fmt.Fprintf(os.Stderr, "Remembering contact '%s'.\n", remember)
 		contacts[remember] = fingerprint
 		contactsReverse[fingerprint] = remember
-		saveContacts(contactsPath)
+		persistContact(contactsPath, remember, fingerprint)
 	}
 
 	if remember == "" && known {
 		fmt.Fprintf(os.Stderr, "The contact is '%s'.\n", name)
 	}
+	return nil
 }
 
 // Implements the -exec option, which runs a given command using /bin/sh, and
 // connects the processes stdin/stdout to this side of the conversation
-func StartCommand(theirFingerprint string) (io.Reader, io.Writer) {
+func StartCommand(theirFingerprint string, contactsReverse map[string]string) (io.Reader, io.Writer) {
 	cmd := exec.Command("/bin/sh", "-c", execCommand, "--", contactsReverse[theirFingerprint])
 	stdIn, err := cmd.StdinPipe()
 	if err != nil {
@@ -79,8 +91,10 @@ func StartCommand(theirFingerprint string) (io.Reader, io.Writer) {
 	return stdOut, stdIn
 }
 
-// Turns a Reader into a channel of buffers
-func readLoop(r io.Reader, ch chan []byte) {
+// Turns a Reader into a channel of buffers.  A read error is reported on
+// errChan rather than exiting the process, so a caller running many
+// conversations concurrently (e.g. -serve) can fail just this one.
+func readLoop(r io.Reader, ch chan []byte, errChan chan error) {
 	for {
 		buf := make([]byte, 4096) // TODO: what's a good buffer size?
 		n, err := r.Read(buf)
@@ -89,13 +103,14 @@ func readLoop(r io.Reader, ch chan []byte) {
 			return
 		}
 		if err != nil {
-			exitError(err)
+			errChan <- err
+			return
 		}
 		ch <- buf[:n]
 	}
 }
 
-func writeLoop(w io.Writer, ch chan []byte) {
+func writeLoop(w io.Writer, ch chan []byte, errChan chan error) {
 	for {
 		buf, open := <-ch
 		if !open {
@@ -103,7 +118,8 @@ func writeLoop(w io.Writer, ch chan []byte) {
 		}
 		_, err := w.Write(buf)
 		if err != nil {
-			exitError(err)
+			errChan <- err
+			return
 		}
 	}
 }
@@ -120,6 +136,31 @@ func sigLoop(ch chan os.Signal) {
 	}
 }
 
+// negotiateFramerOrCancel runs negotiateFramer in the background and gives
+// up if terminate or sigTermChan fires first, closing upstream to unblock
+// its pending read.  Without this, a peer that completes the TCP handshake
+// and then never sends anything (a health check, or just a slow/silent
+// peer) would wedge this connection's goroutine in negotiateFramer forever
+// -- before the main select loop (and its terminate case) even starts --
+// which in -serve mode wedges graceful shutdown, and a -max-conns slot,
+// along with it.  Returns nil if cancelled.
+func negotiateFramerOrCancel(upstream io.ReadWriteCloser, terminate <-chan struct{}, sigTermChan chan os.Signal) Framer {
+	done := make(chan Framer, 1)
+	go func() {
+		done <- negotiateFramer(upstream)
+	}()
+	select {
+	case framer := <-done:
+		return framer
+	case <-terminate:
+		upstream.Close()
+		return nil
+	case <-sigTermChan:
+		upstream.Close()
+		return nil
+	}
+}
+
 // The main loop.
 // * The main job is to pass messages between standard input/output, the OTR
 // library, the TCP socket, and the JSON encoder.
@@ -129,29 +170,38 @@ func sigLoop(ch chan os.Signal) {
 // text.
 // * When an encrypted session has been established, it checks if the contact
 // is authentication and authorised (according to -remember and -expect).
-func mainLoop(privateKey otr.PrivateKey, upstream io.ReadWriter) {
-	var conv otr.Conversation
-	var theirFingerprint string = ""
-
-	conv.PrivateKey = &privateKey
+// * It reports connection-level failures (I/O errors, a rejected contact, a
+// dropped connection) by returning an error rather than exiting the process,
+// so a caller juggling several conversations at once (e.g. -serve) can fail
+// just one of them.  Single-conversation callers should still treat a
+// non-nil return as fatal.
+// terminate, if non-nil, lets the caller ask for a graceful shutdown (the
+// termination messages are sent, and mainLoop waits for the peer to close
+// the connection) without tearing down the whole process; connect/listen/
+// proxy don't need this and pass nil.
+func mainLoop(upstream io.ReadWriteCloser, conv *otr.Conversation, contacts, contactsReverse map[string]string, terminate <-chan struct{}) error {
+	var theirFingerprint string
 
 	netOutChan := make(chan []byte, 100)
 	netInChan := make(chan []byte, 100)
 	stdOutChan := make(chan []byte, 100)
 	stdInChan := make(chan []byte, 100)
 	sigTermChan := make(chan os.Signal)
+	errChan := make(chan error, 4)
 
-	// Encode everything (with JSON) before sending
-	var nl = []byte("\n")
-	msgSender, msgReceiver := NewDelimitedSender(upstream, nl), NewDelimitedReceiver(upstream, nl)
+	go sigLoop(sigTermChan)
 
-	go SendForever(msgSender, netOutChan)
-	go ReceiveForever(msgReceiver, netInChan)
+	framer := negotiateFramerOrCancel(upstream, terminate, sigTermChan)
+	if framer == nil {
+		return nil // cancelled via terminate or SIGTERM before negotiation finished
+	}
+
+	go SendForever(framer, netOutChan, errChan)
+	go ReceiveForever(framer, netInChan, errChan)
 	// Don't touch secret input or output anything until we are sure everything
 	// is encrypted and authorised.
-	// go readLoop(os.Stdin, stdInChan)
-	// go writeLoop(os.Stdout, stdOutChan)
-	go sigLoop(sigTermChan)
+	// go readLoop(os.Stdin, stdInChan, errChan)
+	// go writeLoop(os.Stdout, stdOutChan, errChan)
 
 	send := func(toSend [][]byte) {
 		for _, msg := range toSend {
@@ -162,12 +212,55 @@ func mainLoop(privateKey otr.PrivateKey, upstream io.ReadWriter) {
 	stdInChan <- []byte(otr.QueryMessage) // Queue a handshake message to be sent
 
 	authorised := false // conversation ready to send secret data?
+	smpStarted := false // have we kicked off SMP for this conversation?
+
+	// Hooks up the payload (stdin/stdout, -exec, or a file transfer) once
+	// the contact is authorised.
+	startPayload := func(fingerprint string) {
+		authorised = true
+
+		var r io.Reader
+		var w io.Writer
+		switch {
+		case payloadIO != nil:
+			r, w = payloadIO(fingerprint)
+		case execCommand != "":
+			r, w = StartCommand(fingerprint, contactsReverse)
+		default:
+			r, w = os.Stdin, os.Stdout
+		}
+		go readLoop(r, stdInChan, errChan)
+		go writeLoop(w, stdOutChan, errChan)
+	}
+
+	// Starts (or responds to) SMP authentication of the shared secret given
+	// via -smp-secret, rather than trusting the contact's fingerprint alone.
+	startSMP := func() error {
+		smpStarted = true
+		fmt.Fprintf(os.Stderr, "Authenticating the contact via SMP...\n")
+		toSend, err := conv.Authenticate(smpQuestion, []byte(smpSecret))
+		if err != nil {
+			return err
+		}
+		send(toSend)
+		return nil
+	}
+
 Loop:
 	for {
 		select {
+		case err := <-errChan:
+			if err == errPayloadDone {
+				break Loop
+			}
+			return err
+
 		case _ = <-sigTermChan:
 			break Loop
 
+		case _, _ = <-terminate:
+			break Loop
+
 		case plaintext, alive := <-stdInChan:
 			if !alive {
 				break Loop
@@ -180,49 +273,68 @@ Loop:
 			}
 			toSend, err := conv.Send(plaintext)
 			if err != nil {
-				exitError(err)
+				return err
 			}
 			send(toSend)
 
 		case otrText, alive := <-netInChan:
 			if !alive {
 				if authorised {
-					exitPrintf("Connection dropped!  Recent messages might not be deniable.\n")
+					return fmt.Errorf("Connection dropped!  Recent messages might not be deniable.")
 				}
-				exitPrintf("Connection dropped!\n")
+				return fmt.Errorf("Connection dropped!")
 			}
 			plaintext, encrypted, state, toSend, err := conv.Receive(otrText)
 			if err != nil {
-				exitError(err)
+				return err
 			}
-			if state == otr.ConversationEnded {
-				return
+			switch state {
+			case otr.ConversationEnded:
+				return nil
+			case otr.SMPSecretNeeded:
+				if smpSecret == "" {
+					return fmt.Errorf("The contact wants to verify a shared secret via SMP, " +
+						"but -smp-secret wasn't given.")
+				}
+				if !smpStarted {
+					if err := startSMP(); err != nil {
+						return err
+					}
+				}
+			case otr.SMPComplete:
+				if !authorised {
+					fmt.Fprintf(os.Stderr, "SMP authentication succeeded.\n")
+					if err := authoriseRemember(theirFingerprint, contacts, contactsReverse); err != nil {
+						return err
+					}
+					startPayload(theirFingerprint)
+				}
+			case otr.SMPFailed:
+				return fmt.Errorf("SMP authentication failed; the shared secret didn't match.")
 			}
 			send(toSend)
 			if conv.IsEncrypted() {
 				fingerprint := string(conv.TheirPublicKey.Fingerprint())
-				if authorised && theirFingerprint != fingerprint {
-					exitPrintf("The contact changed mid-conversation.\n")
+				if theirFingerprint != "" && theirFingerprint != fingerprint {
+					return fmt.Errorf("The contact changed mid-conversation.")
 				}
-				if !authorised {
+				if theirFingerprint == "" {
 					theirFingerprint = fingerprint
-					authoriseRemember(fingerprint)
-					authorised = true
-
-					var w io.Writer
-					var r io.Reader
-
-					r, w = os.Stdout, os.Stdin
-					if execCommand != "" {
-						r, w = StartCommand(fingerprint)
+					if smpSecret != "" {
+						if err := startSMP(); err != nil {
+							return err
+						}
+					} else {
+						if err := authoriseRemember(fingerprint, contacts, contactsReverse); err != nil {
+							return err
+						}
+						startPayload(fingerprint)
 					}
-					go readLoop(r, stdInChan)
-					go writeLoop(w, stdOutChan)
 				}
 			}
 			if len(plaintext) > 0 {
 				if !encrypted || !authorised {
-					exitPrintf("Received unencrypted or unauthenticated text.\n")
+					return fmt.Errorf("Received unencrypted or unauthenticated text.")
 				}
 				stdOutChan <- plaintext
 			}
@@ -245,4 +357,5 @@ ShutdownLoop:
 			}
 		}
 	}
+	return nil
 }
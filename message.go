@@ -5,99 +5,253 @@
 // This OTR protocol is designed to work with instant messenger protocols, in
 // which messages are delivered one-by-one.  However, otrcat uses TCP to
 // deliver messages, which combines and splits packets in an ad hoc way.  Our
-// solution is to delimit messages using new-lines.  Newlines are unobtrusive,
-// (especially since OTR messages are base64-sendd), so this shouldn't cause
-// compatibility problems.
+// solution is a Framer, which turns the raw byte stream back into discrete
+// messages.  Several framings are supported (see framerNewline and friends
+// below); the two ends negotiate one at connection start.
 
 package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
-type MessageSender interface {
-	Send([]byte) error
+// Framer turns a raw byte stream into discrete messages.  otrcat layers OTR
+// ciphertext on top of whichever Framer the two ends negotiate.
+type Framer interface {
+	SendFrame(data []byte) error
+	ReceiveFrame() ([]byte, error)
 }
 
-type MessageReceiver interface {
-	Receive() ([]byte, error)
-}
+// maxFrameSize bounds how large a single frame's declared length may be, so
+// a corrupt or hostile peer can't make us allocate unbounded memory.
+const maxFrameSize = 16 * 1024 * 1024
 
-type DelimitedSender struct {
-	Writer    io.Writer
-	delimiter []byte
-}
+// Bits identifying the framers a side of the connection supports, used by
+// negotiateFramer below.  Newline is bit 0 so it's always at least offered,
+// for backward compatibility.
+const (
+	framerNewline = 1 << iota
+	framerLengthPrefixed
+	framerTLV
+)
 
-type DelimitedReceiver struct {
-	Reader    io.Reader
+// ---- newline-delimited framer (the original wire format) ----
+
+type newlineFramer struct {
+	rw        io.ReadWriter
 	delimiter []byte
 	queue     []byte
 }
 
-func NewDelimitedSender(writer io.Writer, delimiter []byte) *DelimitedSender {
-	return &DelimitedSender{writer, delimiter}
-}
-
-func NewDelimitedReceiver(reader io.Reader, delimiter []byte) *DelimitedReceiver {
-	return &DelimitedReceiver{reader, delimiter, []byte{}}
+func newNewlineFramer(rw io.ReadWriter) *newlineFramer {
+	return &newlineFramer{rw, []byte("\n"), []byte{}}
 }
 
-func (s *DelimitedSender) Send(data []byte) (err error) {
-	_, err = s.Writer.Write(append(data, s.delimiter...))
+func (f *newlineFramer) SendFrame(data []byte) (err error) {
+	_, err = f.rw.Write(append(data, f.delimiter...))
 	return
 }
 
-func (r *DelimitedReceiver) Receive() (buf []byte, err error) {
+func (f *newlineFramer) ReceiveFrame() (buf []byte, err error) {
 	var k, n int
 	for {
-		n = bytes.Index(r.queue, r.delimiter)
+		n = bytes.Index(f.queue, f.delimiter)
 		if n != -1 {
 			break
 		}
 		input := make([]byte, 4096)
-		k, err = r.Reader.Read(input)
+		k, err = f.rw.Read(input)
 		if err != nil {
-			if err == io.EOF && len(r.queue) > 0 {
+			if err == io.EOF && len(f.queue) > 0 {
 				return nil, errors.New("Stream closed mid-message")
 			}
 			return
 		}
-		r.queue = append(r.queue, input[:k]...)
+		f.queue = append(f.queue, input[:k]...)
 	}
 
-	buf = r.queue[:n]
-	m := n + len(r.delimiter)
-	if len(r.queue) == m {
-		r.queue = []byte{}
+	buf = f.queue[:n]
+	m := n + len(f.delimiter)
+	if len(f.queue) == m {
+		f.queue = []byte{}
 	} else {
-		r.queue = r.queue[m:]
+		f.queue = f.queue[m:]
+	}
+	return
+}
+
+// ---- length-prefixed framer ----
+
+// lengthPrefixedFramer frames messages with a 4-byte big-endian length
+// prefix.  It's more compact than the newline framer and doesn't need to
+// scan the stream looking for a delimiter.
+type lengthPrefixedFramer struct {
+	rw      io.ReadWriter
+	maxSize uint32
+}
+
+func newLengthPrefixedFramer(rw io.ReadWriter, maxSize uint32) *lengthPrefixedFramer {
+	return &lengthPrefixedFramer{rw, maxSize}
+}
+
+func (f *lengthPrefixedFramer) SendFrame(data []byte) error {
+	if uint32(len(data)) > f.maxSize {
+		return fmt.Errorf("frame too large to send (%d > %d bytes)", len(data), f.maxSize)
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := f.rw.Write(header); err != nil {
+		return err
+	}
+	_, err := f.rw.Write(data)
+	return err
+}
+
+func (f *lengthPrefixedFramer) ReceiveFrame() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f.rw, header); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header)
+	if n > f.maxSize {
+		return nil, fmt.Errorf("peer sent an oversized frame (%d > %d bytes)", n, f.maxSize)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(f.rw, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ---- TLV framer ----
+
+// tlvTypeData identifies an ordinary OTR ciphertext frame.  Other type
+// values are reserved for future control channels (heartbeats, file-transfer
+// chunks, resize events) multiplexed alongside it; ReceiveFrame skips them,
+// but ReceiveTyped gives access to the type byte for subsystems that need it.
+const tlvTypeData = 0x00
+
+type tlvFramer struct {
+	rw      io.ReadWriter
+	maxSize uint32
+}
+
+func newTLVFramer(rw io.ReadWriter) *tlvFramer {
+	return &tlvFramer{rw, maxFrameSize}
+}
+
+func (f *tlvFramer) SendFrame(data []byte) error {
+	return f.SendTyped(tlvTypeData, data)
+}
+
+// SendTyped sends a frame tagged with an arbitrary type byte, for use by
+// control channels layered on top of the TLV framer.
+func (f *tlvFramer) SendTyped(typ byte, data []byte) error {
+	if uint32(len(data)) > f.maxSize {
+		return fmt.Errorf("frame too large to send (%d > %d bytes)", len(data), f.maxSize)
+	}
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := f.rw.Write(header); err != nil {
+		return err
+	}
+	_, err := f.rw.Write(data)
+	return err
+}
+
+func (f *tlvFramer) ReceiveFrame() ([]byte, error) {
+	for {
+		typ, data, err := f.ReceiveTyped()
+		if err != nil {
+			return nil, err
+		}
+		if typ == tlvTypeData {
+			return data, nil
+		}
+		// A control-channel frame arrived ahead of any consumer for it;
+		// drop it rather than blocking the OTR conversation.
 	}
+}
+
+// ReceiveTyped reads the next frame and returns its type byte alongside the
+// payload, for control channels that need to see frames other than
+// tlvTypeData.
+func (f *tlvFramer) ReceiveTyped() (typ byte, data []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(f.rw, header); err != nil {
+		return
+	}
+	typ = header[0]
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > f.maxSize {
+		return 0, nil, fmt.Errorf("peer sent an oversized frame (%d > %d bytes)", n, f.maxSize)
+	}
+	data = make([]byte, n)
+	_, err = io.ReadFull(f.rw, data)
 	return
 }
 
-func SendForever(s MessageSender, ch chan []byte) {
+// negotiateFramer exchanges a one-byte bitmask of locally supported framers
+// with the peer and agrees on the best one both sides understand, preferring
+// the length-prefixed framer, then TLV, then falling back to newline
+// (matching the original wire format) if negotiation fails for any reason.
+// Both ends must run it: a peer that sends no mask byte first is not
+// detected, and the first byte it does send is read as its mask.
+func negotiateFramer(rw io.ReadWriter) Framer {
+	const localMask = framerNewline | framerLengthPrefixed | framerTLV
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := rw.Write([]byte{localMask})
+		writeErr <- err
+	}()
+
+	remote := make([]byte, 1)
+	_, readErr := io.ReadFull(rw, remote)
+	if err := <-writeErr; err != nil || readErr != nil {
+		return newNewlineFramer(rw)
+	}
+
+	switch mutual := localMask & remote[0]; {
+	case mutual&framerLengthPrefixed != 0:
+		return newLengthPrefixedFramer(rw, maxFrameSize)
+	case mutual&framerTLV != 0:
+		return newTLVFramer(rw)
+	default:
+		return newNewlineFramer(rw)
+	}
+}
+
+// SendForever and ReceiveForever report framing errors on errChan rather
+// than exiting, so mainLoop can fail just its own conversation.
+func SendForever(f Framer, ch chan []byte, errChan chan error) {
 	for {
 		msg, open := <-ch
 		if !open || msg == nil {
 			return
 		}
-		if err := s.Send(msg); err != nil {
-			exitError(err)
+		if err := f.SendFrame(msg); err != nil {
+			errChan <- err
+			return
 		}
 	}
 }
 
-func ReceiveForever(r MessageReceiver, ch chan []byte) {
+func ReceiveForever(f Framer, ch chan []byte, errChan chan error) {
 	for {
-		buf, err := r.Receive()
+		buf, err := f.ReceiveFrame()
 		if err == io.EOF {
 			close(ch)
 			return
 		}
 		if err != nil {
-			exitError(err)
+			errChan <- err
+			return
 		}
 		ch <- buf
 	}
@@ -12,7 +12,6 @@ import (
 	"crypto/rand"
 	"flag"
 	"fmt"
-	"net"
 	"os"
 	"strings"
 )
@@ -29,11 +28,10 @@ type Command struct {
 }
 
 var (
-	// Communication state that changes throughout the course of the conversation
-	conv             otr.Conversation
-	theirFingerprint string = ""
-
-	// Contacts, loaded by default from ~/.otrcat/contacts
+	// Contacts, loaded by default from ~/.otrcat/contacts.  connect, listen
+	// and proxy use these directly; listen -serve gives each connection its
+	// own copy (see serve.go), to avoid concurrent conversations racing on
+	// each other's state.
 	contacts        map[string]string = make(map[string]string) // name -> fingerprint
 	contactsReverse map[string]string = make(map[string]string) // fingerprint -> name
 
@@ -48,6 +46,11 @@ var (
 	remember       string
 	expect         string
 	execCommand    string
+	socksAddress   string
+	socksUser      string
+	socksPassword  string
+	smpSecret      string
+	smpQuestion    string
 
 	cmds []Command // Commands (effectively a constant)
 )
@@ -82,6 +85,27 @@ func execFlag(f *flag.FlagSet) {
 	f.StringVar(&execCommand, "exec", "", "shell command to execute with sh(1); the contact is $1")
 }
 
+func smpFlag(f *flag.FlagSet) {
+	f.StringVar(&smpSecret, "smp-secret", "",
+		"a shared secret to authenticate the contact via SMP, on top of the usual -anyone/-remember/-expect checks")
+	f.StringVar(&smpQuestion, "smp-question", "",
+		"an optional question to send along with -smp-secret")
+}
+
+func serveFlag(f *flag.FlagSet) {
+	f.BoolVar(&serve, "serve", false,
+		"keep accepting connections, running an independent conversation per peer")
+	f.IntVar(&maxConns, "max-conns", 0,
+		"maximum number of concurrent connections in -serve mode (0 = unlimited)")
+}
+
+func socksFlag(f *flag.FlagSet) {
+	f.StringVar(&socksAddress, "socks", "",
+		"host:port of a SOCKS5 proxy to dial or accept through, e.g. Tor (127.0.0.1:9050)")
+	f.StringVar(&socksUser, "socks-user", "", "username, if the SOCKS5 proxy requires authentication")
+	f.StringVar(&socksPassword, "socks-pass", "", "password, if the SOCKS5 proxy requires authentication")
+}
+
 // A flag.FlagSet constructor.
 func flags(cmd string, flags ...func(*flag.FlagSet)) *flag.FlagSet {
 	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
@@ -114,10 +138,9 @@ func genkey() {
 	fmt.Fprintf(os.Stderr, "Generating a new private key (%s)...", privateKeyPath)
 	privateKey := new(otr.PrivateKey)
 	privateKey.Generate(rand.Reader)
-	conv.PrivateKey = privateKey
 	fmt.Fprintf(os.Stderr, "\n")
 
-	saveKey(privateKeyPath, privateKey)
+	saveKey(privateKeyPath, privateKey, passphraseFile)
 }
 
 // Parses and checks the flags that are relevant for listen/connect/proxy.
@@ -150,7 +173,7 @@ func parseConversationFlags() {
 
 	if len(args) == 1 {
 		address = args[0]
-		if cmd.name == "listen" {
+		if cmd.name == "listen" || cmd.name == "recvfile" {
 			if !strings.HasPrefix(address, ":") {
 				exitPrintf("Can't listen on a remote address (%s).  "+
 					"Specify a local port with ':port'.\n", address)
@@ -163,7 +186,7 @@ func parseConversationFlags() {
 }
 
 // Selects a private key for use in the conversation
-func useKey(key *otr.PrivateKey) {
+func useKey(conv *otr.Conversation, contacts, contactsReverse map[string]string, key *otr.PrivateKey) {
 	conv.PrivateKey = key
 	fingerprint := string(key.PublicKey.Fingerprint())
 	if _, ok := contacts[fingerprint]; !ok {
@@ -172,50 +195,91 @@ func useKey(key *otr.PrivateKey) {
 	}
 }
 
+// Builds the Transport implied by the -socks flag, or a direct one if it
+// wasn't given.
+func transport() Transport {
+	if socksAddress == "" {
+		return directTransport{}
+	}
+	var auth *socksAuth
+	if socksUser != "" {
+		auth = &socksAuth{socksUser, socksPassword}
+	}
+	return socks5Transport{socksAddress, auth}
+}
+
 func connect() {
-	useKey(loadKey(privateKeyPath))
-	loadContacts(contactsPath)
+	var conv otr.Conversation
+	useKey(&conv, contacts, contactsReverse, loadKey(privateKeyPath))
+	loadContacts(contactsPath, contacts, contactsReverse)
 	parseConversationFlags()
-	conn, err := net.Dial("tcp", address)
+	conn, err := transport().Dial(address)
 	if err != nil {
 		exitError(err)
 	}
-	mainLoop(conn)
+	if err := mainLoop(conn, &conv, contacts, contactsReverse, nil); err != nil {
+		exitError(err)
+	}
 	conn.Close()
 }
 
 func listen() {
-	useKey(loadKey(privateKeyPath))
-	loadContacts(contactsPath)
+	key := loadKey(privateKeyPath)
+	var conv otr.Conversation
+	useKey(&conv, contacts, contactsReverse, key)
+	loadContacts(contactsPath, contacts, contactsReverse)
 	parseConversationFlags()
-	ln, err := net.Listen("tcp", address)
+
+	if serve {
+		if socksAddress != "" {
+			exitPrintf("-serve doesn't support -socks; a SOCKS5 BIND only accepts one connection.\n")
+		}
+		serveLoop(key)
+		return
+	}
+
+	conn, err := transport().Listen(address)
 	if err != nil {
 		exitError(err)
 	}
-	conn, err := ln.Accept()
-	if err != nil {
+	if err := mainLoop(conn, &conv, contacts, contactsReverse, nil); err != nil {
 		exitError(err)
 	}
-	mainLoop(conn)
 	conn.Close()
 }
 
 func proxy() {
-	useKey(loadKey(privateKeyPath))
-	loadContacts(contactsPath)
+	var conv otr.Conversation
+	useKey(&conv, contacts, contactsReverse, loadKey(privateKeyPath))
+	loadContacts(contactsPath, contacts, contactsReverse)
 	parseConversationFlags()
 	cmd, conn, err := startProxy(args)
 	if err != nil {
 		exitError(err)
 	}
-	mainLoop(conn)
+	if err := mainLoop(conn, &conv, contacts, contactsReverse, nil); err != nil {
+		exitError(err)
+	}
 	closeProxy(cmd, conn)
 }
 
+// Changes the passphrase protecting the private key.
+func changepass() {
+	key, migrated := loadKeyMigrating(privateKeyPath, newPassphraseFile)
+	if migrated {
+		// Migrating a legacy key already reseals it under the new
+		// passphrase; don't prompt for and write a second one.
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Key loaded.  Choose a new passphrase.\n")
+	saveKey(privateKeyPath, key, newPassphraseFile)
+}
+
 // Lists all known contacts (including "me")
 func fingerprints() {
-	useKey(loadKey(privateKeyPath))
-	loadContacts(contactsPath)
+	var conv otr.Conversation
+	useKey(&conv, contacts, contactsReverse, loadKey(privateKeyPath))
+	loadContacts(contactsPath, contacts, contactsReverse)
 	for name, fingerprint := range contacts {
 		fmt.Printf("%-20s %x\n", name, fingerprint)
 	}
@@ -258,17 +322,23 @@ func helpCommand(cmd *Command) {
 
 func main() {
 	cmds = []Command{
+		Command{changepass, "changepass", "change the private key's passphrase", []string{},
+			flags("changepass", dirFlag, keyFileFlag, passphraseFlag, newPassphraseFlag)},
 		Command{connect, "connect", "start a conversation", []string{"[host][:port]"},
-			flags("connect", dirFlag, keyFileFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, execFlag)},
+			flags("connect", dirFlag, keyFileFlag, passphraseFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, execFlag, socksFlag, smpFlag)},
 		Command{fingerprints, "fingerprints", "show contacts' fingerprints", []string{},
-			flags("fingerprints", dirFlag, keyFileFlag, contactsFileFlag)},
+			flags("fingerprints", dirFlag, keyFileFlag, passphraseFlag, contactsFileFlag)},
 		Command{genkey, "genkey", "create a new private key", []string{},
-			flags("genkey", dirFlag, keyFileFlag)},
+			flags("genkey", dirFlag, keyFileFlag, passphraseFlag)},
 		Command{help, "help", "help on each command", []string{"[command]"}, flags("help")},
 		Command{listen, "listen", "wait for someone to start a conversation", []string{"[:port]"},
-			flags("listen", dirFlag, keyFileFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, execFlag)},
+			flags("listen", dirFlag, keyFileFlag, passphraseFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, execFlag, socksFlag, smpFlag, serveFlag)},
 		Command{proxy, "proxy", "connect with a proxy command", []string{"command", "[args]"},
-			flags("proxy", dirFlag, keyFileFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, execFlag)},
+			flags("proxy", dirFlag, keyFileFlag, passphraseFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, execFlag, smpFlag)},
+		Command{sendfile, "sendfile", "send a file over an OTR conversation", []string{"[host][:port]"},
+			flags("sendfile", dirFlag, keyFileFlag, passphraseFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, socksFlag, fileFlag, resumeFlag)},
+		Command{recvfile, "recvfile", "receive a file over an OTR conversation", []string{"[:port]"},
+			flags("recvfile", dirFlag, keyFileFlag, passphraseFlag, anyoneFlag, rememberFlag, contactsFileFlag, expectFlag, socksFlag, fileFlag, resumeFlag)},
 	}
 	if len(os.Args) < 2 {
 		help()
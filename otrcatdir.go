@@ -5,18 +5,69 @@
 // The code here manages the otrcat directory (~/.otrcat by default), which
 // contains the private key (id.priv by default) and the contacts list
 // (contacts by default).
+//
+// The private key is encrypted at rest: id.priv holds a small header (magic,
+// scrypt parameters, salt, nonce) followed by the serialized otr.PrivateKey,
+// sealed with crypto/nacl/secretbox under a key derived from the user's
+// passphrase via scrypt.  loadKey also recognises the older plain-base64
+// format and transparently migrates it to this one on first successful load.
 
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/go.crypto/otr"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
+)
+
+const (
+	keyFileMagic = "OTRCATv1"
+
+	// scrypt parameters used for new/migrated/changepass'd keys.  Keys
+	// written with different parameters (should they ever be tuned) remain
+	// readable, since the parameters are stored in the file.
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+
+	saltSize      = 32
+	nonceSize     = 24
+	secretKeySize = 32
+
+	keyHeaderSize = len(keyFileMagic) + 4 + 4 + 4 + saltSize + nonceSize
 )
 
+var passphraseFile string
+
+func passphraseFlag(f *flag.FlagSet) {
+	f.StringVar(&passphraseFile, "passphrase-file", "",
+		"file containing the passphrase that protects the private key; "+
+			"prompted for interactively if omitted")
+}
+
+var newPassphraseFile string
+
+// newPassphraseFlag is only registered for changepass, where -passphrase-file
+// names the key's current passphrase and -new-passphrase-file names the one
+// to replace it with.  Keeping them as separate flags means changepass can't
+// silently re-encrypt a key with the passphrase it already has.
+func newPassphraseFlag(f *flag.FlagSet) {
+	f.StringVar(&newPassphraseFile, "new-passphrase-file", "",
+		"file containing the new passphrase for changepass; "+
+			"prompted for interactively if omitted")
+}
+
 // Establishes that the otrcat directory exists.  If it doesn't, then either
 // fix it or complain about it.
 func establishDir(fix bool) {
@@ -32,10 +83,21 @@ func establishDir(fix bool) {
 	}
 }
 
-// Loads and parses a private key.
+// Loads and parses a private key, migrating it from the legacy plain-base64
+// format if necessary.
 func loadKey(path string) *otr.PrivateKey {
+	key, _ := loadKeyMigrating(path, passphraseFile)
+	return key
+}
+
+// loadKeyMigrating is loadKey, but also reports whether path was in the
+// legacy format and had to be migrated.  changepass uses this: migrating
+// already reseals the key under a new passphrase (read from
+// migratePassphraseFile), so changepass must not prompt for and write a
+// second one right afterwards.
+func loadKeyMigrating(path, migratePassphraseFile string) (key *otr.PrivateKey, migrated bool) {
 	establishDir(false)
-	base64Key, err := ioutil.ReadFile(path)
+	raw, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
 		exitPrintf("The private key (%s) does not exist.  Please use genkey.\n",
 			path)
@@ -44,34 +106,172 @@ func loadKey(path string) *otr.PrivateKey {
 		exitError(err)
 	}
 
+	if !bytes.HasPrefix(raw, []byte(keyFileMagic)) {
+		key = parseLegacyKey(path, raw)
+		fmt.Fprintf(os.Stderr, "Migrating %s to the encrypted key format...\n", path)
+		saveKey(path, key, migratePassphraseFile)
+		return key, true
+	}
+	return decryptKey(path, raw), false
+}
+
+// Encrypts and saves a private key, prompting for a new passphrase (unless
+// newPassphraseFile names a file to read it from).
+func saveKey(path string, key *otr.PrivateKey, newPassphraseFile string) {
+	establishDir(true)
+
+	var rawKey []byte
+	rawKey = key.Serialize(rawKey)
+	defer zero(rawKey)
+
+	passphrase := newPassphrase(newPassphraseFile)
+	defer zero(passphrase)
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		exitError(err)
+	}
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		exitError(err)
+	}
+
+	secretKey := deriveSecretboxKey(passphrase, salt, scryptN, scryptR, scryptP)
+	defer zero(secretKey[:])
+
+	header := new(bytes.Buffer)
+	header.WriteString(keyFileMagic)
+	binary.Write(header, binary.BigEndian, uint32(scryptN))
+	binary.Write(header, binary.BigEndian, uint32(scryptR))
+	binary.Write(header, binary.BigEndian, uint32(scryptP))
+	header.Write(salt)
+	header.Write(nonce[:])
+
+	sealed := secretbox.Seal(header.Bytes(), rawKey, &nonce, secretKey)
+	if err := ioutil.WriteFile(path, sealed, 0600); err != nil {
+		exitError(err)
+	}
+}
+
+// decryptKey parses the header of an encrypted key file, prompts for the
+// passphrase, and opens the sealed private key.
+func decryptKey(path string, raw []byte) *otr.PrivateKey {
+	if len(raw) < keyHeaderSize {
+		exitPrintf("Invalid or corrupted private key (%s).\n", path)
+	}
+
+	fields := bytes.NewReader(raw[len(keyFileMagic):])
+	var n, r, p uint32
+	binary.Read(fields, binary.BigEndian, &n)
+	binary.Read(fields, binary.BigEndian, &r)
+	binary.Read(fields, binary.BigEndian, &p)
+
+	salt := raw[keyHeaderSize-saltSize-nonceSize : keyHeaderSize-nonceSize]
+	var nonce [nonceSize]byte
+	copy(nonce[:], raw[keyHeaderSize-nonceSize:keyHeaderSize])
+	sealed := raw[keyHeaderSize:]
+
+	passphrase := existingPassphrase(path)
+	defer zero(passphrase)
+	secretKey := deriveSecretboxKey(passphrase, salt, int(n), int(r), int(p))
+	defer zero(secretKey[:])
+
+	rawKey, ok := secretbox.Open(nil, sealed, &nonce, secretKey)
+	if !ok {
+		exitPrintf("Incorrect passphrase, or corrupted private key (%s).\n", path)
+	}
+	defer zero(rawKey)
+
+	key := new(otr.PrivateKey)
+	if _, ok := key.Parse(rawKey); !ok {
+		exitPrintf("Invalid or corrupted private key (%s).\n", path)
+	}
+	return key
+}
+
+// parseLegacyKey parses the original plain-base64 key format.
+func parseLegacyKey(path string, base64Key []byte) *otr.PrivateKey {
 	rawKey := make([]byte, base64.StdEncoding.DecodedLen(len(base64Key)))
 	n, err := base64.StdEncoding.Decode(rawKey, base64Key)
 	if err != nil {
 		exitError(err)
 	}
+	defer zero(rawKey[:n])
 
 	key := new(otr.PrivateKey)
 	if _, ok := key.Parse(rawKey[:n]); !ok {
 		exitPrintf("Invalid or corrupted private key (%s).\n", path)
 	}
-
 	return key
 }
 
-func saveKey(path string, key *otr.PrivateKey) {
-	var rawKey []byte
+func deriveSecretboxKey(passphrase, salt []byte, n, r, p int) *[secretKeySize]byte {
+	derived, err := scrypt.Key(passphrase, salt, n, r, p, secretKeySize)
+	if err != nil {
+		exitError(err)
+	}
+	var key [secretKeySize]byte
+	copy(key[:], derived)
+	zero(derived)
+	return &key
+}
 
-	establishDir(true)
-	rawKey = key.Serialize(rawKey)
-	base64Key := make([]byte, base64.StdEncoding.EncodedLen(len(rawKey)))
-	base64.StdEncoding.Encode(base64Key, rawKey)
-	if err := ioutil.WriteFile(path, base64Key, 0600); err != nil {
+// newPassphrase gets a passphrase for a key about to be written, prompting
+// twice (to catch typos) unless file names a passphrase file to read
+// instead.
+func newPassphrase(file string) []byte {
+	if file != "" {
+		return readPassphraseFile(file)
+	}
+	for {
+		p1 := promptPassphrase("New passphrase for the private key: ")
+		p2 := promptPassphrase("Confirm passphrase: ")
+		if bytes.Equal(p1, p2) {
+			zero(p2)
+			return p1
+		}
+		zero(p1)
+		zero(p2)
+		fmt.Fprintf(os.Stderr, "Passphrases didn't match; try again.\n")
+	}
+}
+
+// existingPassphrase gets the passphrase for an already-encrypted key.
+func existingPassphrase(path string) []byte {
+	if passphraseFile != "" {
+		return readPassphraseFile(passphraseFile)
+	}
+	return promptPassphrase(fmt.Sprintf("Passphrase for %s: ", path))
+}
+
+func readPassphraseFile(path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
 		exitError(err)
 	}
+	return bytes.TrimRight(data, "\r\n")
+}
+
+func promptPassphrase(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		exitError(err)
+	}
+	return passphrase
+}
+
+// zero overwrites a buffer's contents, so secrets don't linger in memory
+// longer than necessary.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
 }
 
 // Saves the contact list, i.e. known contacts' names and fingerprints
-func saveContacts(path string) {
+func saveContacts(path string, contacts map[string]string) {
 	establishDir(true)
 	file, err := os.Create(path)
 	if err != nil {
@@ -91,13 +291,13 @@ func saveContacts(path string) {
 }
 
 // Loads the contact list, i.e. known contacts' names and fingerprints
-func loadContacts(path string) {
+func loadContacts(path string, contacts, contactsReverse map[string]string) {
 	establishDir(false)
 	file, err := os.Open(path)
 	if os.IsNotExist(err) {
 		fmt.Fprintf(os.Stderr,
 			"Creating a new contacts file (%s).\n", path)
-		saveContacts(path)
+		saveContacts(path, contacts)
 		return
 	}
 	for {
@@ -120,3 +320,18 @@ func loadContacts(path string) {
 		exitError(err)
 	}
 }
+
+// contactsMutex guards persistContact below, so concurrent conversations in
+// -serve mode don't race on the shared contacts file.  serveLoop also holds
+// it while copying the package-level contacts maps for a new connection.
+var contactsMutex sync.Mutex
+
+// persistContact records a newly-remembered contact in the package-level
+// contacts maps and writes them to disk, serialising concurrent writers.
+func persistContact(path, name, fingerprint string) {
+	contactsMutex.Lock()
+	defer contactsMutex.Unlock()
+	contacts[name] = fingerprint
+	contactsReverse[fingerprint] = name
+	saveContacts(path, contacts)
+}
@@ -19,6 +19,14 @@ type PipePair struct {
 	io.WriteCloser
 }
 
+// Close satisfies io.ReadWriteCloser; without it, PipePair's two embedded
+// Close methods would be an ambiguous selector.  It closes both directions
+// and reports only the write side's error, as closeProxy does.
+func (p PipePair) Close() error {
+	p.ReadCloser.Close()
+	return p.WriteCloser.Close()
+}
+
 func startProxy(args []string) (cmd *exec.Cmd, stdio PipePair, err error) {
 	cmd = exec.Command(args[0], args[1:]...)
 	cmd.Stderr = os.Stderr
@@ -0,0 +1,134 @@
+// Copyright (C) 2014 Andrew Clausen
+// This program may be distributed under the BSD-style licence that Go is
+// released under; see https://golang.org/LICENSE.
+//
+// This file implements "listen -serve", which keeps accepting connections
+// instead of handling a single one and exiting.  Each connection gets its
+// own otr.Conversation and its own copy of the contacts maps, so concurrent
+// conversations can't race on each other's state; newly remembered contacts
+// are still persisted to the shared contacts file via persistContact, which
+// serialises writers with contactsMutex.
+//
+// mainLoop reports connection-level failures (I/O errors, a rejected
+// contact, a dropped connection) by returning an error instead of exiting,
+// so a misbehaving or disconnecting peer only ends its own goroutine; the
+// other active conversations and the listener are unaffected.
+//
+// On SIGTERM, each active connection is asked to shut down gracefully via
+// its terminate channel, which makes mainLoop send the OTR termination
+// messages before returning; the process waits for all of them to finish
+// before exiting, so peers see a clean OTR end rather than the TCP
+// connection just vanishing.
+
+package main
+
+import (
+	"code.google.com/p/go.crypto/otr"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	serve    bool
+	maxConns int
+)
+
+// copyContacts returns a fresh copy of the given contacts/contactsReverse
+// maps, so a connection's goroutine can authorise and remember contacts
+// without racing the maps used by other connections.
+func copyContacts(contacts, contactsReverse map[string]string) (map[string]string, map[string]string) {
+	contactsCopy := make(map[string]string, len(contacts))
+	for name, fingerprint := range contacts {
+		contactsCopy[name] = fingerprint
+	}
+	contactsReverseCopy := make(map[string]string, len(contactsReverse))
+	for fingerprint, name := range contactsReverse {
+		contactsReverseCopy[fingerprint] = name
+	}
+	return contactsCopy, contactsReverseCopy
+}
+
+// serveLoop accepts connections on address until SIGTERM is received,
+// running an independent conversation per connection.  Once -max-conns
+// connections are active, it waits for one of them to end before accepting
+// the next.
+func serveLoop(key *otr.PrivateKey) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		exitError(err)
+	}
+	defer ln.Close()
+
+	var (
+		activeMutex sync.Mutex
+		active      = make(map[*otr.Conversation]chan struct{})
+		wg          sync.WaitGroup
+	)
+
+	// slots, if non-nil, bounds the number of concurrent connections to
+	// -max-conns; Accept blocks on it before accepting the next connection.
+	var slots chan struct{}
+	if maxConns > 0 {
+		slots = make(chan struct{}, maxConns)
+	}
+
+	sigTerm := make(chan os.Signal, 1)
+	signal.Notify(sigTerm, syscall.SIGTERM)
+	go func() {
+		<-sigTerm
+		fmt.Fprintf(os.Stderr, "Received SIGTERM; ending active conversations...\n")
+		activeMutex.Lock()
+		for _, terminate := range active {
+			close(terminate)
+		}
+		activeMutex.Unlock()
+		wg.Wait()
+		os.Exit(0)
+	}()
+
+	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			exitError(err)
+		}
+
+		terminate := make(chan struct{})
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+
+			var conv otr.Conversation
+			contactsMutex.Lock()
+			connContacts, connContactsReverse := copyContacts(contacts, contactsReverse)
+			contactsMutex.Unlock()
+			useKey(&conv, connContacts, connContactsReverse, key)
+
+			activeMutex.Lock()
+			active[&conv] = terminate
+			activeMutex.Unlock()
+			defer func() {
+				activeMutex.Lock()
+				delete(active, &conv)
+				activeMutex.Unlock()
+			}()
+
+			fmt.Fprintf(os.Stderr, "Accepted a connection from %s.\n", conn.RemoteAddr())
+			if err := mainLoop(conn, &conv, connContacts, connContactsReverse, terminate); err != nil {
+				fmt.Fprintf(os.Stderr, "Connection from %s ended: %s\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2014 Andrew Clausen
+// This program may be distributed under the BSD-style licence that Go is
+// released under; see https://golang.org/LICENSE.
+//
+// A minimal SOCKS5 client (RFC 1928), plus username/password authentication
+// (RFC 1929).  Only the CONNECT and BIND commands are implemented; otrcat
+// has no use for UDP ASSOCIATE.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthUserPass     = 0x02
+	socksAuthNoAcceptable = 0xFF
+
+	socksCmdConnect = 0x01
+	socksCmdBind    = 0x02
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded = 0x00
+)
+
+// socksAuth holds optional username/password credentials for the proxy.
+type socksAuth struct {
+	username, password string
+}
+
+// socksDial connects to address through the SOCKS5 proxy at proxyAddr, using
+// the CONNECT command.
+func socksDial(proxyAddr, address string, auth *socksAuth) (io.ReadWriteCloser, error) {
+	conn, err := socksHandshake(proxyAddr, auth)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := socksRequest(conn, socksCmdConnect, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socksBind asks the SOCKS5 proxy at proxyAddr to listen on its end for a
+// connection from address, using the BIND command, and waits for that
+// connection.  Most public SOCKS5 proxies (Tor included) don't implement
+// BIND; the proxy's rejection is reported back to the caller rather than
+// silently falling back to a direct listener.
+func socksBind(proxyAddr, address string, auth *socksAuth) (io.ReadWriteCloser, error) {
+	conn, err := socksHandshake(proxyAddr, auth)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := socksRequest(conn, socksCmdBind, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The second reply arrives once the expected peer connects.
+	if _, _, err := socksReadReply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socksHandshake connects to the proxy and negotiates an authentication
+// method, leaving the connection ready for a CONNECT or BIND request.
+func socksHandshake(proxyAddr string, auth *socksAuth) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []byte{socksAuthNone}
+	if auth != nil {
+		methods = append(methods, socksAuthUserPass)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[0] != socksVersion {
+		conn.Close()
+		return nil, fmt.Errorf("socks: unexpected version %d from proxy", reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+		// Nothing further to do.
+	case socksAuthUserPass:
+		if auth == nil {
+			conn.Close()
+			return nil, errors.New("socks: proxy requires a username and password")
+		}
+		if err := socksAuthenticate(conn, auth); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	case socksAuthNoAcceptable:
+		conn.Close()
+		return nil, errors.New("socks: proxy accepted none of our authentication methods")
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("socks: proxy chose unsupported authentication method %d", reply[1])
+	}
+
+	return conn, nil
+}
+
+func socksAuthenticate(conn net.Conn, auth *socksAuth) error {
+	if len(auth.username) > 255 || len(auth.password) > 255 {
+		return errors.New("socks: username or password too long")
+	}
+	req := []byte{0x01, byte(len(auth.username))}
+	req = append(req, auth.username...)
+	req = append(req, byte(len(auth.password)))
+	req = append(req, auth.password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("socks: authentication rejected")
+	}
+	return nil
+}
+
+// socksRequest sends a CONNECT or BIND request for address (host:port) and
+// reads back one reply.
+func socksRequest(conn net.Conn, cmd byte, address string) (bndAddr string, bndPort uint16, err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("socks: invalid port %q", portStr)
+	}
+
+	req := []byte{socksVersion, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksAtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksAtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return "", 0, errors.New("socks: host name too long")
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	req = append(req, portBytes...)
+
+	if _, err := conn.Write(req); err != nil {
+		return "", 0, err
+	}
+	return socksReadReply(conn)
+}
+
+func socksReadReply(conn net.Conn) (bndAddr string, bndPort uint16, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("socks: unexpected version %d from proxy", header[0])
+	}
+	if header[1] != socksRepSucceeded {
+		return "", 0, fmt.Errorf("socks: proxy refused the request (code %d)", header[1])
+	}
+
+	var addr []byte
+	switch header[3] {
+	case socksAtypIPv4:
+		addr = make([]byte, 4)
+		if _, err = io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		bndAddr = net.IP(addr).String()
+	case socksAtypIPv6:
+		addr = make([]byte, 16)
+		if _, err = io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		bndAddr = net.IP(addr).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		addr = make([]byte, length[0])
+		if _, err = io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		bndAddr = string(addr)
+	default:
+		return "", 0, fmt.Errorf("socks: unknown address type %d from proxy", header[3])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, portBuf); err != nil {
+		return
+	}
+	bndPort = binary.BigEndian.Uint16(portBuf)
+	return
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2014 Andrew Clausen
+// This program may be distributed under the BSD-style licence that Go is
+// released under; see https://golang.org/LICENSE.
+//
+// This file abstracts how otrcat reaches the network, so mainLoop() doesn't
+// need to know whether it's talking to a raw TCP socket or one reached
+// through a SOCKS5 proxy such as Tor.
+
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// Transport obtains the connection used for an OTR conversation.
+type Transport interface {
+	Dial(address string) (io.ReadWriteCloser, error)
+	Listen(address string) (io.ReadWriteCloser, error)
+}
+
+// directTransport dials and listens on the network directly.
+type directTransport struct{}
+
+func (directTransport) Dial(address string) (io.ReadWriteCloser, error) {
+	return net.Dial("tcp", address)
+}
+
+func (directTransport) Listen(address string) (io.ReadWriteCloser, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	return ln.Accept()
+}
+
+// socks5Transport reaches the network through a SOCKS5 proxy, e.g. Tor.
+type socks5Transport struct {
+	proxyAddr string
+	auth      *socksAuth
+}
+
+func (t socks5Transport) Dial(address string) (io.ReadWriteCloser, error) {
+	return socksDial(t.proxyAddr, address, t.auth)
+}
+
+func (t socks5Transport) Listen(address string) (io.ReadWriteCloser, error) {
+	return socksBind(t.proxyAddr, address, t.auth)
+}